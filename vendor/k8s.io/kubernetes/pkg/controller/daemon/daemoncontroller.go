@@ -0,0 +1,1037 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/client/cache"
+	clientset "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	"k8s.io/kubernetes/pkg/client/record"
+	unversionedcore "k8s.io/kubernetes/pkg/client/typed/generated/core/unversioned"
+	"k8s.io/kubernetes/pkg/controller"
+	"k8s.io/kubernetes/pkg/controller/informers"
+	"k8s.io/kubernetes/pkg/labels"
+	utilruntime "k8s.io/kubernetes/pkg/util/runtime"
+	"k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/util/workqueue"
+)
+
+const (
+	// BurstReplicas is a rate limiter for booting pods on a lot of pods.
+	// The value of 250 is chosen b/c values that are too high can cause
+	// excessive CPU consumption by the controller when a large number of
+	// daemon sets are actively churning.
+	BurstReplicas = 250
+
+	// StatusUpdateRetries limits the number of retries if sending a status
+	// update to the API server fails.
+	StatusUpdateRetries = 1
+
+	// daemonSetTemplateHashLabel is stamped onto every pod a DaemonSet creates so that
+	// a later rolling update can tell which pods came from a stale ds.Spec.Template
+	// without having to reconstruct the hash from the live pod spec (which always
+	// differs from the template in fields like NodeName).
+	daemonSetTemplateHashLabel = "pod-template-hash"
+)
+
+// DaemonSetsController is responsible for synchronizing DaemonSet objects stored
+// in the system with actual running pods.
+type DaemonSetsController struct {
+	kubeClient clientset.Interface
+	podControl controller.PodControlInterface
+
+	// eventRecorder lets us surface why a DaemonSet isn't making progress instead of
+	// only logging it.
+	eventRecorder record.EventRecorder
+
+	// At most this many daemon pods are created, and at most this many deleted, in a
+	// single placement pass of one DaemonSet.
+	burstReplicas int
+
+	// To allow injection of syncDaemonSet for testing.
+	syncHandler func(dsKey string) error
+
+	// dsStore can list/get daemonsets from the shared informer's store
+	dsStore cache.StoreToDaemonSetLister
+	// podStore can list/get pods from the shared informer's store
+	podStore cache.StoreToPodLister
+	// nodeStore can list/get nodes from the shared informer's store
+	nodeStore cache.StoreToNodeLister
+
+	// dsStoreSynced returns true if the daemonset store has been synced at least once.
+	dsStoreSynced func() bool
+	// podStoreSynced returns true if the pod store has been synced at least once.
+	podStoreSynced func() bool
+	// nodeStoreSynced returns true if the node store has been synced at least once.
+	nodeStoreSynced func() bool
+
+	// DaemonSet keys that need to be synced.
+	queue workqueue.RateLimitingInterface
+}
+
+// NewDaemonSetsController creates a new DaemonSetsController.
+func NewDaemonSetsController(daemonSetInformer informers.DaemonSetInformer, podInformer informers.PodInformer, nodeInformer informers.NodeInformer, kubeClient clientset.Interface, lookupCacheSize int) *DaemonSetsController {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(glog.Infof)
+	eventBroadcaster.StartRecordingToSink(&unversionedcore.EventSinkImpl{Interface: kubeClient.Core().Events("")})
+
+	dsc := &DaemonSetsController{
+		kubeClient:    kubeClient,
+		podControl:    controller.RealPodControl{KubeClient: kubeClient},
+		eventRecorder: eventBroadcaster.NewRecorder(api.EventSource{Component: "daemonset-controller"}),
+		burstReplicas: BurstReplicas,
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "daemonset"),
+	}
+
+	daemonSetInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    dsc.addDaemonset,
+		UpdateFunc: dsc.updateDaemonset,
+		DeleteFunc: dsc.deleteDaemonset,
+	})
+	dsc.dsStore.Store = daemonSetInformer.Informer().GetStore()
+
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    dsc.addPod,
+		UpdateFunc: dsc.updatePod,
+		DeleteFunc: dsc.deletePod,
+	})
+	dsc.podStore.Indexer = podInformer.Informer().GetIndexer()
+
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    dsc.addNode,
+		UpdateFunc: dsc.updateNode,
+	})
+	dsc.nodeStore.Store = nodeInformer.Informer().GetStore()
+
+	dsc.syncHandler = dsc.syncDaemonSet
+	dsc.dsStoreSynced = daemonSetInformer.Informer().HasSynced
+	dsc.podStoreSynced = podInformer.Informer().HasSynced
+	dsc.nodeStoreSynced = nodeInformer.Informer().HasSynced
+	return dsc
+}
+
+// Run begins watching and syncing daemon sets.
+func (dsc *DaemonSetsController) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer dsc.queue.ShutDown()
+
+	glog.Infof("Starting Daemon Sets controller manager")
+
+	if !cache.WaitForCacheSync(stopCh, dsc.podStoreSynced, dsc.nodeStoreSynced, dsc.dsStoreSynced) {
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(dsc.runWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+	glog.Infof("Shutting down Daemon Set Controller")
+}
+
+func (dsc *DaemonSetsController) runWorker() {
+	for dsc.processNextWorkItem() {
+	}
+}
+
+func (dsc *DaemonSetsController) processNextWorkItem() bool {
+	dsKey, quit := dsc.queue.Get()
+	if quit {
+		return false
+	}
+	defer dsc.queue.Done(dsKey)
+
+	err := dsc.syncHandler(dsKey.(string))
+	if err == nil {
+		dsc.queue.Forget(dsKey)
+		return true
+	}
+
+	glog.Errorf("Error syncing daemon set %v: %v", dsKey, err)
+	dsc.queue.AddRateLimited(dsKey)
+	return true
+}
+
+func (dsc *DaemonSetsController) enqueueDaemonSet(ds *extensions.DaemonSet) {
+	key, err := controller.KeyFunc(ds)
+	if err != nil {
+		glog.Errorf("Couldn't get key for object %#v: %v", ds, err)
+		return
+	}
+	dsc.queue.Add(key)
+}
+
+func (dsc *DaemonSetsController) addDaemonset(obj interface{}) {
+	ds := obj.(*extensions.DaemonSet)
+	glog.V(4).Infof("Adding daemon set %s", ds.Name)
+	dsc.enqueueDaemonSet(ds)
+}
+
+func (dsc *DaemonSetsController) updateDaemonset(old, cur interface{}) {
+	oldDS := old.(*extensions.DaemonSet)
+	curDS := cur.(*extensions.DaemonSet)
+	glog.V(4).Infof("Updating daemon set %s", oldDS.Name)
+	dsc.enqueueDaemonSet(curDS)
+}
+
+func (dsc *DaemonSetsController) deleteDaemonset(obj interface{}) {
+	ds, ok := obj.(*extensions.DaemonSet)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			glog.Errorf("Couldn't get object from tombstone %#v", obj)
+			return
+		}
+		ds, ok = tombstone.Obj.(*extensions.DaemonSet)
+		if !ok {
+			glog.Errorf("Tombstone contained object that is not a DaemonSet %#v", obj)
+			return
+		}
+	}
+	glog.V(4).Infof("Deleting daemon set %s", ds.Name)
+	dsc.enqueueDaemonSet(ds)
+}
+
+// getPodDaemonSet returns the DaemonSet managing the given pod, or nil if none matches.
+func (dsc *DaemonSetsController) getPodDaemonSet(pod *api.Pod) *extensions.DaemonSet {
+	sets, err := dsc.dsStore.GetPodDaemonSets(pod)
+	if err != nil {
+		return nil
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	return &sets[0]
+}
+
+func (dsc *DaemonSetsController) addPod(obj interface{}) {
+	pod := obj.(*api.Pod)
+	if ds := dsc.getPodDaemonSet(pod); ds != nil {
+		dsc.enqueueDaemonSet(ds)
+	}
+}
+
+func (dsc *DaemonSetsController) updatePod(old, cur interface{}) {
+	curPod := cur.(*api.Pod)
+	oldPod := old.(*api.Pod)
+	if curPod.ResourceVersion == oldPod.ResourceVersion {
+		return
+	}
+	if ds := dsc.getPodDaemonSet(curPod); ds != nil {
+		dsc.enqueueDaemonSet(ds)
+	}
+}
+
+func (dsc *DaemonSetsController) deletePod(obj interface{}) {
+	pod, ok := obj.(*api.Pod)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			glog.Errorf("Couldn't get object from tombstone %#v", obj)
+			return
+		}
+		pod, ok = tombstone.Obj.(*api.Pod)
+		if !ok {
+			glog.Errorf("Tombstone contained object that is not a Pod %#v", obj)
+			return
+		}
+	}
+	if ds := dsc.getPodDaemonSet(pod); ds != nil {
+		dsc.enqueueDaemonSet(ds)
+	}
+}
+
+func (dsc *DaemonSetsController) addNode(obj interface{}) {
+	dsList, err := dsc.dsStore.List()
+	if err != nil {
+		glog.V(4).Infof("Error listing daemonsets: %v", err)
+		return
+	}
+	for i := range dsList {
+		ds := &dsList[i]
+		dsc.enqueueDaemonSet(ds)
+	}
+}
+
+func (dsc *DaemonSetsController) updateNode(old, cur interface{}) {
+	oldNode := old.(*api.Node)
+	curNode := cur.(*api.Node)
+	if reflect.DeepEqual(oldNode.Labels, curNode.Labels) && reflect.DeepEqual(oldNode.Spec.Taints, curNode.Spec.Taints) {
+		return
+	}
+	dsList, err := dsc.dsStore.List()
+	if err != nil {
+		glog.V(4).Infof("Error listing daemonsets: %v", err)
+		return
+	}
+	for i := range dsList {
+		ds := &dsList[i]
+		dsc.enqueueDaemonSet(ds)
+	}
+}
+
+// podsOnNode returns the non-terminal pods currently scheduled onto node, regardless
+// of which controller (if any) owns them. It is used when checking whether a daemon
+// pod can fit onto a node without conflicting with whatever else is already there.
+func (dsc *DaemonSetsController) podsOnNode(nodeName string) ([]*api.Pod, error) {
+	allPods, err := dsc.podStore.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var pods []*api.Pod
+	for i := range allPods {
+		pod := allPods[i]
+		if pod.Spec.NodeName != nodeName {
+			continue
+		}
+		if pod.Status.Phase == api.PodSucceeded || pod.Status.Phase == api.PodFailed {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+// nodeShouldRunDaemonPod reports two things about a daemon pod belonging to ds on node:
+// shouldRun is whether a new pod should be created there (full predicates, including
+// out-of-disk, host port/resource fit, and tolerance of NoSchedule/NoExecute taints);
+// shouldContinueRunning is whether a pod already running there should be left alone
+// (NoExecute tolerance only) so that a node relabel, a newly-added NoSchedule taint or
+// a transient resource crunch doesn't churn an already-scheduled daemon pod.
+func (dsc *DaemonSetsController) nodeShouldRunDaemonPod(node *api.Node, ds *extensions.DaemonSet) (shouldRun, shouldContinueRunning bool) {
+	newPod := &api.Pod{Spec: ds.Spec.Template.Spec, ObjectMeta: ds.Spec.Template.ObjectMeta}
+	newPod.Spec.NodeName = node.Name
+
+	selector, err := unversioned.LabelSelectorAsSelector(ds.Spec.Selector)
+	if err != nil {
+		glog.Warningf("Unable to convert selector for daemon set %s/%s: %v", ds.Namespace, ds.Name, err)
+		return false, false
+	}
+	dsSelector := selector
+
+	// shouldContinueRunning only requires tolerating NoExecute taints, so an already
+	// running pod isn't churned by e.g. a node relabel or a new NoSchedule taint. Compute
+	// it up front so every rejection below reports the same, correct value instead of
+	// hard-coding false.
+	shouldContinueRunning = podToleratesNodeTaints(newPod, node, api.TaintEffectNoExecute)
+
+	if len(newPod.Spec.NodeSelector) > 0 {
+		nodeSelector := labels.Set(newPod.Spec.NodeSelector).AsSelector()
+		if !nodeSelector.Matches(labels.Set(node.Labels)) {
+			dsc.recordFailedPlacement(ds, node, "NodeSelectorMismatch", "node doesn't match the pod template's node selector")
+			return false, shouldContinueRunning
+		}
+	}
+	if ds.Spec.Template.Spec.NodeName != "" && ds.Spec.Template.Spec.NodeName != node.Name {
+		return false, shouldContinueRunning
+	}
+	if !affinityMatches(node, newPod) {
+		dsc.recordFailedPlacement(ds, node, "NodeAffinityMismatch", "node doesn't match the pod template's node affinity")
+		return false, shouldContinueRunning
+	}
+
+	if !shouldContinueRunning {
+		// An untolerated NoExecute taint disqualifies the pod outright, whether or not
+		// it's already running.
+		dsc.recordFailedPlacement(ds, node, "Untolerated", "node has a NoExecute taint the pod template doesn't tolerate")
+		return false, false
+	}
+
+	for _, c := range node.Status.Conditions {
+		if c.Type == api.NodeOutOfDisk && c.Status == api.ConditionTrue {
+			dsc.recordFailedPlacement(ds, node, "NodeOutOfDisk", "node is out of disk space")
+			return false, shouldContinueRunning
+		}
+	}
+	if !podToleratesNodeTaints(newPod, node, api.TaintEffectNoSchedule, api.TaintEffectNoExecute) {
+		dsc.recordFailedPlacement(ds, node, "Untolerated", "node has a taint the pod template doesn't tolerate")
+		return false, shouldContinueRunning
+	}
+
+	existingPods, err := dsc.podsOnNode(node.Name)
+	if err != nil {
+		glog.Warningf("Unable to list pods on node %s: %v", node.Name, err)
+		return false, shouldContinueRunning
+	}
+	var otherPods []*api.Pod
+	for _, pod := range existingPods {
+		if dsSelector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		otherPods = append(otherPods, pod)
+	}
+
+	if !podFitsHostPorts(newPod, otherPods) {
+		dsc.recordFailedPlacement(ds, node, "PortConflict", "pod's host ports conflict with another pod already on the node")
+		return false, shouldContinueRunning
+	}
+	if !podFitsResources(newPod, otherPods, node) {
+		dsc.recordFailedPlacement(ds, node, "InsufficientResources", "node doesn't have enough free resources for the pod")
+		return false, shouldContinueRunning
+	}
+	return true, shouldContinueRunning
+}
+
+// recordFailedPlacement emits a FailedPlacement event carrying the specific reason a
+// node was rejected, so operators can see why a DaemonSet isn't making progress without
+// having to dig through controller logs.
+func (dsc *DaemonSetsController) recordFailedPlacement(ds *extensions.DaemonSet, node *api.Node, reason, message string) {
+	dsc.eventRecorder.Eventf(ds, api.EventTypeWarning, "FailedPlacement", "Can't place pod on node %s (%s): %s", node.Name, reason, message)
+}
+
+// nodeRunState is the pair of booleans nodeShouldRunDaemonPod returns for a given node.
+type nodeRunState struct {
+	shouldRun, shouldContinueRunning bool
+}
+
+// nodeRunStates resolves nodeShouldRunDaemonPod once per node for ds, so that manage()
+// and updateDaemonSetStatus() can share the result instead of each recomputing it (and,
+// since nodeShouldRunDaemonPod now records FailedPlacement events as a side effect,
+// each emitting a duplicate event per rejected node every sync).
+func (dsc *DaemonSetsController) nodeRunStates(ds *extensions.DaemonSet, nodeList *api.NodeList) map[string]nodeRunState {
+	states := make(map[string]nodeRunState, len(nodeList.Items))
+	for i := range nodeList.Items {
+		node := &nodeList.Items[i]
+		shouldRun, shouldContinueRunning := dsc.nodeShouldRunDaemonPod(node, ds)
+		states[node.Name] = nodeRunState{shouldRun: shouldRun, shouldContinueRunning: shouldContinueRunning}
+	}
+	return states
+}
+
+// podToleratesNodeTaints reports whether pod tolerates every taint on node whose effect
+// is one of effects. TolerationSeconds is ignored here: it only bounds how long the
+// taint manager lets the toleration last, not whether scheduling/continued-running is
+// permitted in the first place.
+func podToleratesNodeTaints(pod *api.Pod, node *api.Node, effects ...api.TaintEffect) bool {
+	for _, taint := range node.Spec.Taints {
+		matchesEffect := false
+		for _, effect := range effects {
+			if taint.Effect == effect {
+				matchesEffect = true
+				break
+			}
+		}
+		if !matchesEffect {
+			continue
+		}
+		if !tolerationsTolerateTaint(pod.Spec.Tolerations, &taint) {
+			return false
+		}
+	}
+	return true
+}
+
+func tolerationsTolerateTaint(tolerations []api.Toleration, taint *api.Taint) bool {
+	for _, toleration := range tolerations {
+		if toleration.Effect != "" && toleration.Effect != taint.Effect {
+			continue
+		}
+		if toleration.Key != "" && toleration.Key != taint.Key {
+			continue
+		}
+		switch toleration.Operator {
+		case api.TolerationOpExists, "":
+			return true
+		case api.TolerationOpEqual:
+			if toleration.Value == taint.Value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// affinityMatches returns true if pod has no node affinity requirement, or if node
+// satisfies the pod's requiredDuringSchedulingIgnoredDuringExecution node affinity.
+// Only match expressions with the In operator are evaluated; an expression with any
+// other operator is treated as satisfied, and an affinity annotation that fails to
+// parse is treated as no requirement.
+func affinityMatches(node *api.Node, pod *api.Pod) bool {
+	affinity, err := api.GetAffinityFromPodAnnotations(pod.Annotations)
+	if err != nil {
+		glog.V(4).Infof("Error reading affinity annotation for pod %s: %v", pod.Name, err)
+		return true
+	}
+	if affinity == nil || affinity.NodeAffinity == nil {
+		return true
+	}
+	nodeAffinity := affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return true
+	}
+	nodeSelector := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	for _, term := range nodeSelector.NodeSelectorTerms {
+		match := true
+		for _, expr := range term.MatchExpressions {
+			if expr.Operator != api.NodeSelectorOpIn {
+				continue
+			}
+			nodeValue, ok := node.Labels[expr.Key]
+			if !ok {
+				match = false
+				break
+			}
+			found := false
+			for _, v := range expr.Values {
+				if v == nodeValue {
+					found = true
+					break
+				}
+			}
+			if !found {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func podFitsHostPorts(pod *api.Pod, otherPods []*api.Pod) bool {
+	wantPorts := usedPorts(pod)
+	if len(wantPorts) == 0 {
+		return true
+	}
+	for _, other := range otherPods {
+		for port := range usedPorts(other) {
+			if wantPorts[port] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func usedPorts(pod *api.Pod) map[int]bool {
+	ports := map[int]bool{}
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.HostPort != 0 {
+				ports[p.HostPort] = true
+			}
+		}
+	}
+	return ports
+}
+
+func podFitsResources(pod *api.Pod, otherPods []*api.Pod, node *api.Node) bool {
+	podRequest := resourceRequests(pod)
+	if podRequest.milliCPU == 0 && podRequest.memory == 0 {
+		return true
+	}
+	var usedCPU, usedMemory, usedPods int64
+	for _, other := range otherPods {
+		r := resourceRequests(other)
+		usedCPU += r.milliCPU
+		usedMemory += r.memory
+		usedPods++
+	}
+	allocatable := node.Status.Allocatable
+	if cpu, ok := allocatable[api.ResourceCPU]; ok {
+		if usedCPU+podRequest.milliCPU > cpu.MilliValue() {
+			return false
+		}
+	}
+	if mem, ok := allocatable[api.ResourceMemory]; ok {
+		if usedMemory+podRequest.memory > mem.Value() {
+			return false
+		}
+	}
+	if pods, ok := allocatable[api.ResourcePods]; ok {
+		if usedPods+1 > pods.Value() {
+			return false
+		}
+	}
+	return true
+}
+
+type resourceCount struct {
+	milliCPU int64
+	memory   int64
+}
+
+func resourceRequests(pod *api.Pod) resourceCount {
+	var rc resourceCount
+	for _, c := range pod.Spec.Containers {
+		if cpu, ok := c.Resources.Requests[api.ResourceCPU]; ok {
+			rc.milliCPU += cpu.MilliValue()
+		}
+		if mem, ok := c.Resources.Requests[api.ResourceMemory]; ok {
+			rc.memory += mem.Value()
+		}
+	}
+	return rc
+}
+
+// podByCreationTimestamp sorts pods by creation timestamp, oldest first.
+type podByCreationTimestamp []*api.Pod
+
+func (o podByCreationTimestamp) Len() int      { return len(o) }
+func (o podByCreationTimestamp) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o podByCreationTimestamp) Less(i, j int) bool {
+	if o[i].CreationTimestamp.Equal(o[j].CreationTimestamp) {
+		return o[i].Name < o[j].Name
+	}
+	return o[i].CreationTimestamp.Before(o[j].CreationTimestamp)
+}
+
+// getControllerOf returns the controller ownerRef of pod, or nil if it has none.
+func getControllerOf(pod *api.Pod) *api.OwnerReference {
+	for i := range pod.OwnerReferences {
+		ref := &pod.OwnerReferences[i]
+		if ref.Controller != nil && *ref.Controller {
+			return ref
+		}
+	}
+	return nil
+}
+
+// adoptPod patches pod to add a controller ownerRef pointing at ds.
+func (dsc *DaemonSetsController) adoptPod(ds *extensions.DaemonSet, pod *api.Pod) error {
+	patch := fmt.Sprintf(
+		`{"metadata":{"ownerReferences":[{"apiVersion":"extensions/v1beta1","kind":"DaemonSet","name":%q,"uid":%q,"controller":true}],"uid":%q}}`,
+		ds.Name, ds.UID, pod.UID)
+	_, err := dsc.kubeClient.Core().Pods(pod.Namespace).Patch(pod.Name, api.StrategicMergePatchType, []byte(patch))
+	return err
+}
+
+// releasePod patches pod to remove the given controller ownerRef, freeing it up to be
+// adopted by whichever controller's selector matches it next.
+func (dsc *DaemonSetsController) releasePod(pod *api.Pod, controllerRef *api.OwnerReference) error {
+	patch := fmt.Sprintf(
+		`{"metadata":{"ownerReferences":[{"$patch":"delete","uid":%q}],"uid":%q}}`,
+		controllerRef.UID, pod.UID)
+	_, err := dsc.kubeClient.Core().Pods(pod.Namespace).Patch(pod.Name, api.StrategicMergePatchType, []byte(patch))
+	return err
+}
+
+// findConflictingDaemonSet returns another DaemonSet in dsList whose selector also
+// matches pod, if any. Two DaemonSets should never claim the same pod.
+func findConflictingDaemonSet(ds *extensions.DaemonSet, pod *api.Pod, dsList []extensions.DaemonSet) *extensions.DaemonSet {
+	for i := range dsList {
+		other := &dsList[i]
+		if other.UID == ds.UID || other.Namespace != pod.Namespace {
+			continue
+		}
+		otherSelector, err := unversioned.LabelSelectorAsSelector(other.Spec.Selector)
+		if err != nil || otherSelector.Empty() {
+			continue
+		}
+		if otherSelector.Matches(labels.Set(pod.Labels)) {
+			return other
+		}
+	}
+	return nil
+}
+
+// getDaemonPods returns the pods ds controls, plus the set of nodes that already have a
+// pod matching ds's selector but owned by a different controller (manage() leaves those
+// nodes alone entirely, rather than risk creating a second, competing pod doing the same
+// job). The returned pods are: pods already adopted that still match its selector, and
+// newly adopted pods that match but had no controller, with orphaned pods (no longer
+// matching) released along the way. Pods already owned by a different controller are
+// left untouched, and adoption backs off whenever another DaemonSet's selector also
+// matches the candidate pod, since resolving that overlap isn't this controller's call.
+func (dsc *DaemonSetsController) getDaemonPods(ds *extensions.DaemonSet) ([]*api.Pod, map[string]bool, error) {
+	selector, err := unversioned.LabelSelectorAsSelector(ds.Spec.Selector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candidates, err := dsc.podStore.Pods(ds.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, nil, err
+	}
+	dsList, err := dsc.dsStore.List()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pods []*api.Pod
+	foreignNodes := make(map[string]bool)
+	for _, pod := range candidates {
+		matches := selector.Matches(labels.Set(pod.Labels))
+		controllerRef := getControllerOf(pod)
+
+		if controllerRef != nil {
+			if controllerRef.UID != ds.UID {
+				// Owned by someone else; never touch it, but if it also matches our
+				// selector, remember its node so manage() doesn't create a competitor.
+				if matches {
+					foreignNodes[pod.Spec.NodeName] = true
+				}
+				continue
+			}
+			if !matches {
+				if err := dsc.releasePod(pod, controllerRef); err != nil {
+					glog.Warningf("Unable to release pod %s/%s from daemon set %s: %v", pod.Namespace, pod.Name, ds.Name, err)
+				}
+				continue
+			}
+			pods = append(pods, pod)
+			continue
+		}
+
+		if !matches {
+			continue
+		}
+		if owner := findConflictingDaemonSet(ds, pod, dsList); owner != nil {
+			dsc.eventRecorder.Eventf(ds, api.EventTypeWarning, "ConflictingDaemonSet", "Pod %s is also selected by daemon set %s/%s; skipping sync until the overlap is resolved", pod.Name, owner.Namespace, owner.Name)
+			return nil, nil, fmt.Errorf("daemon set %s/%s and %s/%s both select pod %s; skipping sync until the overlap is resolved", ds.Namespace, ds.Name, owner.Namespace, owner.Name, pod.Name)
+		}
+		if err := dsc.adoptPod(ds, pod); err != nil {
+			glog.Warningf("Unable to adopt pod %s/%s for daemon set %s: %v", pod.Namespace, pod.Name, ds.Name, err)
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	return pods, foreignNodes, nil
+}
+
+// nodesToDaemonPods groups pods (as already resolved by a single getDaemonPods call) by
+// the node they are scheduled on. A pod that is terminal (Succeeded/Failed) or has a
+// non-nil DeletionTimestamp is excluded from the mapping unless includeDeletedTerminal
+// is true: the placement pass wants a replacement created right away rather than
+// waiting for such a pod to finalize its delete, while status counting still wants to
+// see every pod that currently exists.
+func nodesToDaemonPods(pods []*api.Pod, includeDeletedTerminal bool) map[string][]*api.Pod {
+	nodeToDaemonPods := make(map[string][]*api.Pod)
+	for _, pod := range pods {
+		if !includeDeletedTerminal && isPodDeletedOrTerminal(pod) {
+			continue
+		}
+		nodeToDaemonPods[pod.Spec.NodeName] = append(nodeToDaemonPods[pod.Spec.NodeName], pod)
+	}
+	return nodeToDaemonPods
+}
+
+// isPodDeletedOrTerminal reports whether pod is on its way out: either already marked
+// for deletion, or in a terminal phase it will never leave.
+func isPodDeletedOrTerminal(pod *api.Pod) bool {
+	return pod.DeletionTimestamp != nil || pod.Status.Phase == api.PodSucceeded || pod.Status.Phase == api.PodFailed
+}
+
+// manage performs the normal placement pass: it creates daemon pods on every node
+// that should be running one and doesn't have one yet, and deletes daemon pods from
+// nodes that should no longer be running one (or that have more than one). pods and
+// foreignNodes are resolved once per sync by syncDaemonSet's single getDaemonPods call;
+// nodeStates is resolved once per sync from that same node list, so every node's
+// predicates - and whatever FailedPlacement event they emit - are computed exactly once.
+func (dsc *DaemonSetsController) manage(ds *extensions.DaemonSet, pods []*api.Pod, nodeStates map[string]nodeRunState, foreignNodes map[string]bool) error {
+	nodeToDaemonPods := nodesToDaemonPods(pods, false)
+
+	var nodesNeedingDaemonPods, podsToDelete []string
+	for nodeName, state := range nodeStates {
+		daemonPods, exists := nodeToDaemonPods[nodeName]
+
+		switch {
+		case state.shouldRun && !exists && !foreignNodes[nodeName]:
+			nodesNeedingDaemonPods = append(nodesNeedingDaemonPods, nodeName)
+		case state.shouldContinueRunning && len(daemonPods) > 1:
+			// Keep the oldest, drop the rest; it's the only situation where we might
+			// want to run and still have extra copies lying around.
+			sort.Sort(podByCreationTimestamp(daemonPods))
+			for i := 1; i < len(daemonPods); i++ {
+				podsToDelete = append(podsToDelete, daemonPods[i].Name)
+			}
+		case !state.shouldContinueRunning && exists:
+			for _, pod := range daemonPods {
+				podsToDelete = append(podsToDelete, pod.Name)
+			}
+		}
+	}
+
+	createDiff := len(nodesNeedingDaemonPods)
+	deleteDiff := len(podsToDelete)
+
+	if createDiff > dsc.burstReplicas {
+		createDiff = dsc.burstReplicas
+	}
+	if deleteDiff > dsc.burstReplicas {
+		deleteDiff = dsc.burstReplicas
+	}
+
+	template := templateWithHashLabel(&ds.Spec.Template)
+
+	var errs []error
+	for i := 0; i < createDiff; i++ {
+		if err := dsc.podControl.CreatePods(ds.Namespace, template, ds); err != nil {
+			dsc.eventRecorder.Eventf(ds, api.EventTypeWarning, "FailedCreate", "Error creating daemon pod: %v", err)
+			errs = append(errs, err)
+			continue
+		}
+		dsc.eventRecorder.Eventf(ds, api.EventTypeNormal, "SuccessfulCreate", "Created daemon pod")
+	}
+	for i := 0; i < deleteDiff; i++ {
+		if err := dsc.podControl.DeletePod(ds.Namespace, podsToDelete[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// computeHash returns an fnv hash of the labels and pod spec of the given template, used
+// to detect whether a daemon pod was created from an older revision of ds.Spec.Template.
+// Fields that legitimately differ between the template and a pod created from it (name,
+// generated name, owner references, ...) are deliberately excluded.
+func computeHash(template *api.PodTemplateSpec) uint32 {
+	hasher := fnv.New32a()
+	// JSON rather than %#v: %#v prints nested pointer fields as memory addresses, which
+	// would make two decoded copies of the same template hash differently.
+	json.NewEncoder(hasher).Encode(struct {
+		Labels map[string]string
+		Spec   api.PodSpec
+	}{template.Labels, template.Spec})
+	return hasher.Sum32()
+}
+
+// templateWithHashLabel returns a copy of template with daemonSetTemplateHashLabel set to
+// the template's current hash, so that pods created from it can later be recognized as
+// stale once ds.Spec.Template changes.
+func templateWithHashLabel(template *api.PodTemplateSpec) *api.PodTemplateSpec {
+	out := *template
+	out.ObjectMeta.Labels = labels.Merge(template.ObjectMeta.Labels, map[string]string{
+		daemonSetTemplateHashLabel: fmt.Sprintf("%d", computeHash(template)),
+	})
+	return &out
+}
+
+// isPodAvailable mirrors controller.IsPodAvailable: a pod is available once it has
+// been Ready for at least minReadySeconds.
+func isPodAvailable(pod *api.Pod, minReadySeconds int32, now time.Time) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type != api.PodReady || c.Status != api.ConditionTrue {
+			continue
+		}
+		if minReadySeconds == 0 {
+			return true
+		}
+		if !c.LastTransitionTime.IsZero() && c.LastTransitionTime.Add(time.Duration(minReadySeconds)*time.Second).Before(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollingUpdate replaces daemon pods whose template hash is stale with fresh ones,
+// throttled by ds.Spec.UpdateStrategy.RollingUpdate.MaxUnavailable and only once enough
+// of the existing pods have become available per MinReadySeconds. pods is the set of
+// pods ds controls, already resolved once per sync by syncDaemonSet.
+func (dsc *DaemonSetsController) rollingUpdate(ds *extensions.DaemonSet, pods []*api.Pod) error {
+	nodeToDaemonPods := nodesToDaemonPods(pods, false)
+
+	rollingUpdate := ds.Spec.UpdateStrategy.RollingUpdate
+	if rollingUpdate == nil {
+		return nil
+	}
+
+	maxUnavailable := 1
+	if rollingUpdate.MaxUnavailable > 0 {
+		maxUnavailable = rollingUpdate.MaxUnavailable
+	}
+	minReadySeconds := rollingUpdate.MinReadySeconds
+	currentHash := fmt.Sprintf("%d", computeHash(&ds.Spec.Template))
+	now := time.Now()
+
+	var oldPods []*api.Pod
+	numUnavailable := 0
+	for _, pods := range nodeToDaemonPods {
+		nodeAvailable := false
+		for _, pod := range pods {
+			if pod.Labels[daemonSetTemplateHashLabel] != currentHash {
+				oldPods = append(oldPods, pod)
+			}
+			if isPodAvailable(pod, minReadySeconds, now) {
+				nodeAvailable = true
+			}
+		}
+		if !nodeAvailable {
+			numUnavailable++
+		}
+	}
+
+	sort.Sort(podByCreationTimestamp(oldPods))
+
+	var errs []error
+	for _, pod := range oldPods {
+		if numUnavailable >= maxUnavailable {
+			break
+		}
+		if err := dsc.podControl.DeletePod(ds.Namespace, pod.Name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		numUnavailable++
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// updateDaemonSetStatus recomputes and, if necessary, persists ds.Status. pods is the
+// set of pods ds controls, already resolved once per sync by syncDaemonSet.
+func (dsc *DaemonSetsController) updateDaemonSetStatus(ds *extensions.DaemonSet, pods []*api.Pod, nodeStates map[string]nodeRunState) error {
+	nodeToDaemonPods := nodesToDaemonPods(pods, true)
+
+	minReadySeconds := int32(0)
+	if ds.Spec.UpdateStrategy.RollingUpdate != nil {
+		minReadySeconds = ds.Spec.UpdateStrategy.RollingUpdate.MinReadySeconds
+	}
+	now := time.Now()
+
+	var desiredNumberScheduled, currentNumberScheduled, numberReady, numberAvailable int32
+	for nodeName, state := range nodeStates {
+		if state.shouldRun {
+			desiredNumberScheduled++
+		}
+		nodePods, exists := nodeToDaemonPods[nodeName]
+		if !exists {
+			continue
+		}
+		currentNumberScheduled++
+
+		nodeReady := false
+		nodeAvailable := false
+		for _, pod := range nodePods {
+			for _, c := range pod.Status.Conditions {
+				if c.Type == api.PodReady && c.Status == api.ConditionTrue {
+					nodeReady = true
+					break
+				}
+			}
+			if isPodAvailable(pod, minReadySeconds, now) {
+				nodeAvailable = true
+			}
+		}
+		if nodeReady {
+			numberReady++
+		}
+		if nodeAvailable {
+			numberAvailable++
+		}
+	}
+	numberUnavailable := desiredNumberScheduled - numberAvailable
+
+	if ds.Status.DesiredNumberScheduled == desiredNumberScheduled &&
+		ds.Status.CurrentNumberScheduled == currentNumberScheduled &&
+		ds.Status.NumberReady == numberReady &&
+		ds.Status.NumberAvailable == numberAvailable &&
+		ds.Status.NumberUnavailable == numberUnavailable {
+		return nil
+	}
+
+	copyObj, err := api.Scheme.Copy(ds)
+	if err != nil {
+		return fmt.Errorf("unable to copy daemon set %q: %v", ds.Name, err)
+	}
+	toUpdate := copyObj.(*extensions.DaemonSet)
+	var updateErr error
+	for i := 0; i <= StatusUpdateRetries; i++ {
+		toUpdate.Status.DesiredNumberScheduled = desiredNumberScheduled
+		toUpdate.Status.CurrentNumberScheduled = currentNumberScheduled
+		toUpdate.Status.NumberReady = numberReady
+		toUpdate.Status.NumberAvailable = numberAvailable
+		toUpdate.Status.NumberUnavailable = numberUnavailable
+		_, updateErr = dsc.kubeClient.Extensions().DaemonSets(ds.Namespace).UpdateStatus(toUpdate)
+		if updateErr == nil {
+			return nil
+		}
+	}
+	return updateErr
+}
+
+// syncDaemonSet synchronizes a single DaemonSet with the current state of nodes and pods.
+func (dsc *DaemonSetsController) syncDaemonSet(key string) error {
+	startTime := time.Now()
+	defer func() {
+		glog.V(4).Infof("Finished syncing daemon set %q (%v)", key, time.Now().Sub(startTime))
+	}()
+
+	if !dsc.podStoreSynced() || !dsc.nodeStoreSynced() || !dsc.dsStoreSynced() {
+		dsc.queue.Add(key)
+		return nil
+	}
+
+	obj, exists, err := dsc.dsStore.GetByKey(key)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve daemon set %v from store: %v", key, err)
+	}
+	if !exists {
+		return nil
+	}
+	ds := obj.(*extensions.DaemonSet)
+
+	everything := unversioned.LabelSelector{}
+	if reflect.DeepEqual(ds.Spec.Selector, &everything) {
+		glog.Warningf("Refusing to sync daemon set %q that selects all pods via an empty selector", key)
+		dsc.eventRecorder.Eventf(ds, api.EventTypeWarning, "SelectingAll", "This daemon set is selecting all pods. A non-empty selector is required.")
+		return nil
+	}
+
+	if ds.DeletionTimestamp != nil {
+		return nil
+	}
+
+	// Resolve ds's pods once per sync - adoption and orphaning issue real patch calls,
+	// so doing this again for each of manage/rollingUpdate/updateDaemonSetStatus below
+	// would re-patch the same pods up to three times per reconcile. foreignNodes comes
+	// from the same pass, so it doesn't need a second, independent pod listing either.
+	pods, foreignNodes, err := dsc.getDaemonPods(ds)
+	if err != nil {
+		return err
+	}
+
+	// Likewise, resolve nodeShouldRunDaemonPod once per node per sync: it now records
+	// a FailedPlacement event as a side effect, so calling it again from
+	// updateDaemonSetStatus below would double the event for every rejected node.
+	nodeList, err := dsc.nodeStore.List()
+	if err != nil {
+		return fmt.Errorf("couldn't list nodes: %v", err)
+	}
+	nodeStates := dsc.nodeRunStates(ds, nodeList)
+
+	if err := dsc.manage(ds, pods, nodeStates, foreignNodes); err != nil {
+		return err
+	}
+
+	switch ds.Spec.UpdateStrategy.Type {
+	case extensions.RollingUpdateDaemonSetStrategyType:
+		if err := dsc.rollingUpdate(ds, pods); err != nil {
+			return err
+		}
+	}
+
+	return dsc.updateDaemonSetStatus(ds, pods, nodeStates)
+}
@@ -18,6 +18,7 @@ package daemon
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"k8s.io/kubernetes/pkg/api"
@@ -28,11 +29,13 @@ import (
 	"k8s.io/kubernetes/pkg/apis/extensions"
 	"k8s.io/kubernetes/pkg/client/cache"
 	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/fake"
+	"k8s.io/kubernetes/pkg/client/record"
 	"k8s.io/kubernetes/pkg/client/testing/core"
 	"k8s.io/kubernetes/pkg/controller"
 	"k8s.io/kubernetes/pkg/controller/informers"
 	"k8s.io/kubernetes/pkg/runtime"
 	"k8s.io/kubernetes/pkg/securitycontext"
+	"k8s.io/kubernetes/pkg/types"
 )
 
 var (
@@ -58,6 +61,7 @@ func newDaemonSet(name string) *extensions.DaemonSet {
 		ObjectMeta: api.ObjectMeta{
 			Name:      name,
 			Namespace: api.NamespaceDefault,
+			UID:       types.UID(name),
 		},
 		Spec: extensions.DaemonSetSpec{
 			Selector: &unversioned.LabelSelector{MatchLabels: simpleDaemonSetLabel},
@@ -148,9 +152,29 @@ func newTestController(initialObjects ...runtime.Object) (*DaemonSetsController,
 	manager.dsStoreSynced = alwaysReady
 	podControl := &controller.FakePodControl{}
 	manager.podControl = podControl
+	manager.eventRecorder = record.NewFakeRecorder(100)
 	return manager, podControl, clientset
 }
 
+// fakeRecorder returns manager's injected record.FakeRecorder so a test can assert on
+// the events emitted during a sync.
+func fakeRecorder(manager *DaemonSetsController) *record.FakeRecorder {
+	return manager.eventRecorder.(*record.FakeRecorder)
+}
+
+// expectFailedPlacementEvent reads the next event from manager's event recorder and
+// fails the test unless it is a FailedPlacement event mentioning reason.
+func expectFailedPlacementEvent(t *testing.T, manager *DaemonSetsController, reason string) {
+	select {
+	case event := <-fakeRecorder(manager).Events:
+		if !strings.Contains(event, "FailedPlacement") || !strings.Contains(event, reason) {
+			t.Errorf("expected a FailedPlacement event mentioning %s, got %q", reason, event)
+		}
+	default:
+		t.Errorf("expected a FailedPlacement event mentioning %s, got none", reason)
+	}
+}
+
 func validateSyncDaemonSets(t *testing.T, fakePodControl *controller.FakePodControl, expectedCreates, expectedDeletes int) {
 	if len(fakePodControl.Templates) != expectedCreates {
 		t.Errorf("Unexpected number of creates.  Expected %d, saw %d\n", expectedCreates, len(fakePodControl.Templates))
@@ -230,6 +254,26 @@ func TestOutOfDiskNodeDaemonDoesNotLaunchPod(t *testing.T) {
 	ds := newDaemonSet("foo")
 	manager.dsStore.Add(ds)
 	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+	expectFailedPlacementEvent(t, manager, "NodeOutOfDisk")
+}
+
+// A single sync must record each rejected node's FailedPlacement event exactly once,
+// even though both manage() and updateDaemonSetStatus() care about the node's
+// shouldRun/shouldContinueRunning verdict.
+func TestFailedPlacementEventNotDuplicatedPerSync(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	node := newNode("not-enough-disk", nil)
+	node.Status.Conditions = []api.NodeCondition{{Type: api.NodeOutOfDisk, Status: api.ConditionTrue}}
+	manager.nodeStore.Add(node)
+	ds := newDaemonSet("foo")
+	manager.dsStore.Add(ds)
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+	expectFailedPlacementEvent(t, manager, "NodeOutOfDisk")
+	select {
+	case event := <-fakeRecorder(manager).Events:
+		t.Errorf("expected only one FailedPlacement event per sync, got a second: %q", event)
+	default:
+	}
 }
 
 func resourcePodSpec(nodeName, memory, cpu string) api.PodSpec {
@@ -265,6 +309,7 @@ func TestInsufficentCapacityNodeDaemonDoesNotLaunchPod(t *testing.T) {
 	ds.Spec.Template.Spec = podSpec
 	manager.dsStore.Add(ds)
 	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+	expectFailedPlacementEvent(t, manager, "InsufficientResources")
 }
 
 func TestSufficentCapacityWithTerminatedPodsDaemonLaunchesPod(t *testing.T) {
@@ -338,6 +383,7 @@ func TestPortConflictNodeDaemonDoesNotLaunchPod(t *testing.T) {
 	ds.Spec.Template.Spec = podSpec
 	manager.dsStore.Add(ds)
 	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+	expectFailedPlacementEvent(t, manager, "PortConflict")
 }
 
 // Test that if the node is already scheduled with a pod using a host port
@@ -606,3 +652,271 @@ func TestNumberReadyStatus(t *testing.T) {
 		t.Errorf("Wrong daemon %s status: %v", updated.Name, updated.Status)
 	}
 }
+
+func newRollingUpdateDaemonSet(name string, maxUnavailable int) *extensions.DaemonSet {
+	ds := newDaemonSet(name)
+	ds.Spec.UpdateStrategy = extensions.DaemonSetUpdateStrategy{
+		Type: extensions.RollingUpdateDaemonSetStrategyType,
+		RollingUpdate: &extensions.RollingUpdateDaemonSet{
+			MaxUnavailable: maxUnavailable,
+		},
+	}
+	return ds
+}
+
+// addDaemonPod adds a pod to podStore that looks like it was created by manager for ds,
+// stamping it with the template hash for templateDS so tests can control whether it's
+// "current" or "old" from the rolling update's point of view.
+func addDaemonPod(podStore cache.Indexer, nodeName string, templateDS *extensions.DaemonSet, ready bool) *api.Pod {
+	// Copy the labels: simpleDaemonSetLabel is shared with the DaemonSet's template and
+	// selector, and writing the hash into it would change the template's own hash.
+	podLabels := map[string]string{daemonSetTemplateHashLabel: fmt.Sprintf("%d", computeHash(&templateDS.Spec.Template))}
+	for k, v := range simpleDaemonSetLabel {
+		podLabels[k] = v
+	}
+	pod := newPod(fmt.Sprintf("%s-", nodeName), nodeName, podLabels)
+	if ready {
+		pod.Status.Conditions = append(pod.Status.Conditions, api.PodCondition{Type: api.PodReady, Status: api.ConditionTrue})
+	}
+	podStore.Add(pod)
+	return pod
+}
+
+// RollingUpdate should do nothing when every daemon pod already matches the current template.
+func TestRollingUpdateNoopWhenPodsCurrent(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	addNodes(manager.nodeStore.Store, 0, 5, nil)
+	ds := newRollingUpdateDaemonSet("foo", 1)
+	manager.dsStore.Add(ds)
+	for i := 0; i < 5; i++ {
+		addDaemonPod(manager.podStore.Indexer, fmt.Sprintf("node-%d", i), ds, true)
+	}
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+}
+
+// RollingUpdate should replace stale pods across many nodes, throttled by maxUnavailable.
+func TestRollingUpdateStagedReplacement(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	addNodes(manager.nodeStore.Store, 0, 5, nil)
+	staleDS := newRollingUpdateDaemonSet("foo", 2)
+	ds := newRollingUpdateDaemonSet("foo", 2)
+	ds.Spec.Template.Spec.Containers[0].Image = "foo/bar:v2"
+	manager.dsStore.Add(ds)
+	for i := 0; i < 5; i++ {
+		addDaemonPod(manager.podStore.Indexer, fmt.Sprintf("node-%d", i), staleDS, true)
+	}
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 2)
+}
+
+// RollingUpdate should only delete maxUnavailable stale pods per sync, even with more available capacity.
+func TestRollingUpdateThrottlesByMaxUnavailable(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	addNodes(manager.nodeStore.Store, 0, 5, nil)
+	staleDS := newRollingUpdateDaemonSet("foo", 1)
+	ds := newRollingUpdateDaemonSet("foo", 1)
+	ds.Spec.Template.Spec.Containers[0].Image = "foo/bar:v2"
+	manager.dsStore.Add(ds)
+	for i := 0; i < 5; i++ {
+		addDaemonPod(manager.podStore.Indexer, fmt.Sprintf("node-%d", i), staleDS, true)
+	}
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 1)
+}
+
+// RollingUpdate should not delete any stale pods until they have become available.
+func TestRollingUpdateBlocksOnUnavailablePods(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	addNodes(manager.nodeStore.Store, 0, 5, nil)
+	staleDS := newRollingUpdateDaemonSet("foo", 2)
+	ds := newRollingUpdateDaemonSet("foo", 2)
+	ds.Spec.Template.Spec.Containers[0].Image = "foo/bar:v2"
+	manager.dsStore.Add(ds)
+	for i := 0; i < 5; i++ {
+		addDaemonPod(manager.podStore.Indexer, fmt.Sprintf("node-%d", i), staleDS, false)
+	}
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func newControllerRef(ownerUID types.UID) api.OwnerReference {
+	return api.OwnerReference{UID: ownerUID, Controller: boolPtr(true)}
+}
+
+func hasPatchAction(actions []core.Action, podName string) bool {
+	for _, action := range actions {
+		patchAction, ok := action.(core.PatchAction)
+		if !ok || action.GetResource().Resource != "pods" {
+			continue
+		}
+		if patchAction.GetName() == podName {
+			return true
+		}
+	}
+	return false
+}
+
+// A pod matching the DaemonSet's selector but with no controller ref should be adopted,
+// not recreated.
+func TestAdoptsMatchingOrphanPod(t *testing.T) {
+	manager, podControl, clientset := newTestController()
+	manager.nodeStore.Store.Add(newNode("node-0", nil))
+	pod := newPod("node-0-", "node-0", simpleDaemonSetLabel)
+	manager.podStore.Indexer.Add(pod)
+	ds := newDaemonSet("foo")
+	manager.dsStore.Add(ds)
+
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+	if !hasPatchAction(clientset.Actions(), pod.Name) {
+		t.Errorf("expected an adoption patch for pod %s, got actions: %#v", pod.Name, clientset.Actions())
+	}
+}
+
+// A pod that no longer matches its owning DaemonSet's selector should be released, and a
+// fresh daemon pod created to take its place.
+func TestReleasesPodOnSelectorChange(t *testing.T) {
+	manager, podControl, clientset := newTestController()
+	manager.nodeStore.Store.Add(newNode("node-0", nil))
+	ds := newDaemonSet("foo")
+	pod := newPod("node-0-", "node-0", simpleDaemonSetLabel2)
+	pod.OwnerReferences = []api.OwnerReference{newControllerRef(ds.UID)}
+	manager.podStore.Indexer.Add(pod)
+	manager.dsStore.Add(ds)
+
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 1, 0)
+	if !hasPatchAction(clientset.Actions(), pod.Name) {
+		t.Errorf("expected a release patch for pod %s, got actions: %#v", pod.Name, clientset.Actions())
+	}
+}
+
+// A pod matching the DaemonSet's selector but controlled by a different controller must
+// never be deleted or recreated over.
+func TestDoesNotTouchPodOwnedByAnotherController(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	manager.nodeStore.Store.Add(newNode("node-0", nil))
+	ds := newDaemonSet("foo")
+	pod := newPod("node-0-", "node-0", simpleDaemonSetLabel)
+	pod.OwnerReferences = []api.OwnerReference{newControllerRef(types.UID("someone-else"))}
+	manager.podStore.Indexer.Add(pod)
+	manager.dsStore.Add(ds)
+
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+}
+
+// An orphan pod matched by two DaemonSets' selectors should not be adopted by either;
+// the sync should back off and emit a ConflictingDaemonSet event instead.
+func TestConflictingDaemonSetsSkipSyncWithEvent(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	manager.nodeStore.Store.Add(newNode("node-0", nil))
+	ds := newDaemonSet("foo")
+	other := newDaemonSet("bar")
+	pod := newPod("node-0-", "node-0", simpleDaemonSetLabel)
+	manager.podStore.Indexer.Add(pod)
+	manager.dsStore.Add(ds)
+	manager.dsStore.Add(other)
+
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+	select {
+	case event := <-fakeRecorder(manager).Events:
+		if !strings.Contains(event, "ConflictingDaemonSet") {
+			t.Errorf("expected a ConflictingDaemonSet event, got %q", event)
+		}
+	default:
+		t.Errorf("expected a ConflictingDaemonSet event, got none")
+	}
+}
+
+// A NoSchedule taint the DaemonSet's pod doesn't tolerate should block pod creation.
+func TestTaintedNodeNoScheduleDoesNotLaunchPod(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	node := newNode("tainted", nil)
+	node.Spec.Taints = []api.Taint{{Key: "dedicated", Value: "special", Effect: api.TaintEffectNoSchedule}}
+	manager.nodeStore.Store.Add(node)
+	ds := newDaemonSet("foo")
+	manager.dsStore.Add(ds)
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+}
+
+// A matching Toleration should let the pod be created on an otherwise tainted node.
+func TestTaintedNodeWithMatchingTolerationLaunchesPod(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	node := newNode("tainted", nil)
+	node.Spec.Taints = []api.Taint{{Key: "dedicated", Value: "special", Effect: api.TaintEffectNoSchedule}}
+	manager.nodeStore.Store.Add(node)
+	ds := newDaemonSet("foo")
+	ds.Spec.Template.Spec.Tolerations = []api.Toleration{
+		{Key: "dedicated", Operator: api.TolerationOpEqual, Value: "special", Effect: api.TaintEffectNoSchedule},
+	}
+	manager.dsStore.Add(ds)
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 1, 0)
+}
+
+// A NoExecute taint added after the daemon pod is already running should trigger its
+// deletion, even though the same taint as NoSchedule would have left it alone.
+func TestNoExecuteTaintAddedLaterDeletesPod(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	node := newNode("node-0", nil)
+	node.Spec.Taints = []api.Taint{{Key: "dedicated", Value: "special", Effect: api.TaintEffectNoExecute}}
+	manager.nodeStore.Store.Add(node)
+	ds := newDaemonSet("foo")
+	addPods(manager.podStore.Indexer, "node-0", simpleDaemonSetLabel, 1)
+	manager.dsStore.Add(ds)
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 1)
+}
+
+// TolerationSeconds bounds how long the taint manager honors a toleration, but it
+// shouldn't block the daemon controller from treating the toleration as satisfied.
+func TestNoExecuteTaintWithTolerationSecondsIsTolerated(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	node := newNode("node-0", nil)
+	node.Spec.Taints = []api.Taint{{Key: "dedicated", Value: "special", Effect: api.TaintEffectNoExecute}}
+	manager.nodeStore.Store.Add(node)
+	ds := newDaemonSet("foo")
+	seconds := int64(300)
+	ds.Spec.Template.Spec.Tolerations = []api.Toleration{
+		{Key: "dedicated", Operator: api.TolerationOpEqual, Value: "special", Effect: api.TaintEffectNoExecute, TolerationSeconds: &seconds},
+	}
+	addPods(manager.podStore.Indexer, "node-0", simpleDaemonSetLabel, 1)
+	manager.dsStore.Add(ds)
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+}
+
+// A node relabel that makes the node stop matching the pod template's node selector
+// shouldn't churn an already-running daemon pod there, only block new placement.
+func TestNodeSelectorMismatchDoesNotDeleteRunningPod(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	node := newNode("node-0", nil)
+	manager.nodeStore.Store.Add(node)
+	ds := newDaemonSet("foo")
+	ds.Spec.Template.Spec.NodeSelector = map[string]string{"color": "blue"}
+	addPods(manager.podStore.Indexer, "node-0", simpleDaemonSetLabel, 1)
+	manager.dsStore.Add(ds)
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 0, 0)
+}
+
+// A pod that is still Running but already has a DeletionTimestamp set shouldn't count
+// as "already scheduled" on its node, so the replacement pod is created right away
+// instead of waiting for the delete to finalize.
+func TestTerminatingPodDoesNotBlockNewPodCreation(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	manager.nodeStore.Store.Add(newNode("node-0", nil))
+	pod := newPod("node-0-", "node-0", simpleDaemonSetLabel)
+	now := unversioned.Now()
+	pod.DeletionTimestamp = &now
+	manager.podStore.Indexer.Add(pod)
+	ds := newDaemonSet("foo")
+	manager.dsStore.Add(ds)
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 1, 0)
+}
+
+// A Failed pod left behind on a node shouldn't count as "already scheduled" either, so
+// a fresh daemon pod is created to replace it.
+func TestFailedPodOnNodeLaunchesReplacementPod(t *testing.T) {
+	manager, podControl, _ := newTestController()
+	manager.nodeStore.Store.Add(newNode("node-0", nil))
+	pod := newPod("node-0-", "node-0", simpleDaemonSetLabel)
+	pod.Status.Phase = api.PodFailed
+	manager.podStore.Indexer.Add(pod)
+	ds := newDaemonSet("foo")
+	manager.dsStore.Add(ds)
+	syncAndValidateDaemonSets(t, manager, ds, podControl, 1, 0)
+}